@@ -0,0 +1,6 @@
+module Main where
+
+import QuorumTools.Mains.LocalHealth
+
+main :: IO ()
+main = localHealthMain
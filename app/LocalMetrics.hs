@@ -0,0 +1,6 @@
+module Main where
+
+import QuorumTools.Mains.LocalMetrics
+
+main :: IO ()
+main = localMetricsMain
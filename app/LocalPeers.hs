@@ -0,0 +1,6 @@
+module Main where
+
+import QuorumTools.Mains.LocalPeers
+
+main :: IO ()
+main = localPeersMain
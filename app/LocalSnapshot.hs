@@ -0,0 +1,6 @@
+module Main where
+
+import QuorumTools.Mains.LocalSnapshot
+
+main :: IO ()
+main = localSnapshotMain
@@ -0,0 +1,6 @@
+module Main where
+
+import QuorumTools.Mains.LocalTrace
+
+main :: IO ()
+main = localTraceMain
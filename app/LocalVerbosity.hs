@@ -0,0 +1,6 @@
+module Main where
+
+import QuorumTools.Mains.LocalVerbosity
+
+main :: IO ()
+main = localVerbosityMain
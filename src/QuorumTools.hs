@@ -3,18 +3,48 @@ module QuorumTools where
 
 import Control.Concurrent
 
+import QuorumTools.Mains.LocalHealth (localHealthMain)
+
+import QuorumTools.Mains.LocalMetrics (localMetricsMain)
+
 import QuorumTools.Mains.LocalNew (localNewMain)
 
+import QuorumTools.Mains.LocalPeers (localPeersMain)
+
+import QuorumTools.Mains.LocalSnapshot (localSnapshotMain)
+
 import QuorumTools.Mains.LocalSpam (LocalSpamConfig(..))
 import qualified QuorumTools.Mains.LocalSpam as LocalSpam
 
 import QuorumTools.Mains.LocalStart (localStartMain)
 
+import QuorumTools.Mains.LocalTrace (localTraceMain)
+
+import QuorumTools.Mains.LocalVerbosity (localVerbosityMain)
+
+localHealth :: IO ThreadId
+localHealth = forkIO localHealthMain
+
+localMetrics :: IO ThreadId
+localMetrics = forkIO localMetricsMain
+
 localNew :: IO ThreadId
 localNew = forkIO localNewMain
 
+localPeers :: IO ThreadId
+localPeers = forkIO localPeersMain
+
+localSnapshot :: IO ThreadId
+localSnapshot = forkIO localSnapshotMain
+
 localSpam :: LocalSpamConfig -> IO ThreadId
 localSpam = forkIO . LocalSpam.localSpam
 
 localStart :: IO ThreadId
 localStart = forkIO localStartMain
+
+localTrace :: IO ThreadId
+localTrace = forkIO localTraceMain
+
+localVerbosity :: IO ThreadId
+localVerbosity = forkIO localVerbosityMain
@@ -16,16 +16,30 @@ module QuorumTools.Client
   , loadNode
   , perSecond
   , addNode
+  , joinRaftCluster
   , removeNode
+  , decommissionNode
+  , blockNumber
+  , peerCount
+  , raftRole
+  , peerNodeIds
+  , pendingTxCount
+  , setVerbosity
+  , setClusterVerbosity
+  , traceTransaction
+  , transactionReceipt
+  , recentTxIds
   ) where
 
-import           Control.Lens            (Fold, to, (^.), (^?))
+import           Control.Exception       (try)
+import           Control.Lens            (Fold, to, toListOf, (^.), (^?))
 import           Control.RateLimit       (RateLimit (PerExecution),
                                           dontCombine,
                                           generateRateLimitedFunction)
-import           Data.Aeson              (Value (Array, String), object,
+import           Data.Aeson              (Value (Array, Null, String), object,
                                           toJSON, (.=))
-import           Data.Aeson.Lens         (key, _Integral, _Null, _String)
+import           Data.Aeson.Lens         (key, values, _Integral, _Null,
+                                          _String)
 import           Data.Aeson.Types        (Pair)
 import qualified Data.ByteString         as BS
 import qualified Data.ByteString.Lazy    as LSB
@@ -36,14 +50,17 @@ import qualified Data.Text.Encoding      as T
 import           Data.Text.Lazy          (toStrict)
 import qualified Data.Text.Lazy.Encoding as LT
 import           Data.Time.Units
+import           Data.Traversable        (for)
 import qualified Data.Vector             as V
-import           Network.HTTP.Client     (defaultManagerSettings)
+import           Network.HTTP.Client     (HttpException,
+                                          defaultManagerSettings)
 import           Network.Wreq            (Response, post, responseBody)
 import qualified Network.Wreq.Session    as Sess
 import           Prelude                 hiding (FilePath, lines)
 import           Turtle                  hiding (Fold)
 
 import           QuorumTools.Cluster
+import           QuorumTools.Constellation (constellationRuntimePaths)
 import qualified QuorumTools.Metrics     as Metrics
 import           QuorumTools.Types
 import           QuorumTools.Util
@@ -103,6 +120,25 @@ sendBody (Tx maybeTo method privacy sync) geth = object
           Nothing -> params
           Just toBytes -> params <> ["to" .= hexPrefixed toBytes]
 
+-- | A transaction to the zero address with an arbitrary payload. For a
+-- private transaction, the payload is stored by constellation and only its
+-- hash makes it on chain, so the size is bounded by geth's limit on HTTP
+-- request bodies rather than the block gas limit.
+payloadBody :: Int -> Privacy -> Geth -> Value
+payloadBody size privacy geth = object
+    [ "id"      .= i 1
+    , "jsonrpc" .= t "2.0"
+    , "method"  .= opName Sync
+    , "params"  .=
+      [ object $ setPrivateFor privacy
+        [ "from" .= showGethAccountId geth
+        , "to"   .= hexPrefixed (intToBytes20 0)
+        , "data" .= ("0x" <> T.replicate size "ab")
+        , "gas"  .= t "0x47B760"
+        ]
+      ]
+    ]
+
 createBody :: CreateArgs -> Geth -> Value
 createBody
   (CreateArgs (Contract privacy _methods bytecode _abi) initVal sync)
@@ -134,6 +170,14 @@ callBody (CallArgs toBytes method) geth = object
     ]
   ]
 
+rpcBody :: Text -> [Value] -> Value
+rpcBody method params = object
+  [ "id"      .= i 1
+  , "jsonrpc" .= t "2.0"
+  , "method"  .= method
+  , "params"  .= params
+  ]
+
 extractResult :: Fold Value a -> Response LSB.ByteString -> Either Text a
 extractResult subfield r = fromMaybe parseFailure mParsed
   where
@@ -142,6 +186,15 @@ extractResult subfield r = fromMaybe parseFailure mParsed
     mParsed = r^?responseBody.key "result".subfield.to Right
           <|> r^?responseBody.key "error".key "message"._String.to Left
 
+rpcRequest :: MonadIO m
+           => Geth -> Fold Value a -> Text -> [Value] -> m (Either Text a)
+rpcRequest geth subfield method params = liftIO $ extractResult subfield <$>
+  post (T.unpack (gethUrl geth)) (rpcBody method params)
+
+-- | Parses a hex-encoded JSON-RPC quantity, e.g. @"0x1a"@.
+quantity :: Fold Value Int
+quantity = _String . to textToBytes . traverse . to toInt . traverse
+
 call :: MonadIO io => Geth -> CallArgs -> io (Either Text BS.ByteString)
 call geth args =
     liftIO $ extract <$> post (T.unpack (gethUrl geth)) (callBody args geth)
@@ -182,6 +235,15 @@ addNode geth (EnodeId eid) = liftIO $
       , "params"  .= [String eid]
       ]
 
+-- | Adds a node to a raft cluster via an existing member. The newcomer is
+-- returned with the raft ID the cluster assigned it, ready to be started with
+-- @--raftjoinexisting@.
+joinRaftCluster :: MonadIO m => Geth -> Geth -> m (Either Text Geth)
+joinRaftCluster member newcomer =
+    fmap joining <$> addNode member (gethEnodeId newcomer)
+  where
+    joining raftId = newcomer { gethId = raftId, gethJoinMode = JoinExisting }
+
 removeNode :: MonadIO m => Geth -> GethId -> m (Either Text ())
 removeNode geth gid = liftIO $ extractResult (to $ const ()) <$> post url body
   where
@@ -195,6 +257,109 @@ removeNode geth gid = liftIO $ extractResult (to $ const ()) <$> post url body
       , "params"  .= [toJSON (gId gid)]
       ]
 
+blockNumber :: MonadIO m => Geth -> m (Either Text Int)
+blockNumber geth = rpcRequest geth quantity "eth_blockNumber" []
+
+peerCount :: MonadIO m => Geth -> m (Either Text Int)
+peerCount geth = rpcRequest geth quantity "net_peerCount" []
+
+-- | The node IDs (the hex part of their enode IDs) of the node's peers
+peerNodeIds :: MonadIO m => Geth -> m (Either Text [Text])
+peerNodeIds geth = rpcRequest geth ids "admin_peers" []
+  where
+    ids :: Fold Value [Text]
+    ids = to $ toListOf $ values . key "id" . _String
+
+pendingTxCount :: MonadIO m => Geth -> m (Either Text Int)
+pendingTxCount geth =
+  rpcRequest geth (key "pending" . quantity) "txpool_status" []
+
+-- | One of "minter" or "verifier" once the node has joined a raft cluster
+raftRole :: MonadIO m => Geth -> m (Either Text Text)
+raftRole geth = rpcRequest geth _String "raft_role" []
+
+-- | Changes the log verbosity of a running node. This requires the debug RPC
+-- API, and does not persist across restarts.
+setVerbosity :: MonadIO m => Geth -> Verbosity -> m (Either Text ())
+setVerbosity geth (Verbosity level) =
+  rpcRequest geth (_Null . to (const ())) "debug_verbosity" [toJSON level]
+
+setClusterVerbosity :: (MonadIO m, Traversable t)
+                    => Verbosity -> t Geth -> m (t (Either Text ()))
+setClusterVerbosity level = traverse (`setVerbosity` level)
+
+-- | Replays a transaction with one of geth's tracers (e.g. @callTracer@ or
+-- @prestateTracer@), or with the default struct logger. For a private
+-- transaction, only its participants replay the private payload.
+traceTransaction :: MonadIO m
+                 => Geth -> Maybe Text -> TxId -> m (Either Text Value)
+traceTransaction geth tracer (TxId tid) =
+    rpcRequest geth (to id) "debug_traceTransaction"
+      [toJSON (hexPrefixed tid), opts]
+
+  where
+    opts = object $ maybe [] (\name -> ["tracer" .= name]) tracer
+
+-- | The receipt of a mined transaction, or 'Nothing' if the node doesn't know
+-- of one. A receipt missing any of the fields we compare is an error, rather
+-- than being mistaken for a missing one.
+transactionReceipt :: MonadIO m
+                   => Geth -> TxId -> m (Either Text (Maybe Receipt))
+transactionReceipt geth (TxId tid) =
+    rpcRequest geth (to receiptOrNull . traverse) "eth_getTransactionReceipt"
+      [toJSON (hexPrefixed tid)]
+
+  where
+    -- Nothing here makes rpcRequest report the response as unparseable
+    receiptOrNull :: Value -> Maybe (Maybe Receipt)
+    receiptOrNull Null = Just Nothing
+    receiptOrNull v    = Just <$> parseReceipt v
+
+    parseReceipt :: Value -> Maybe Receipt
+    parseReceipt v = Receipt
+      <$> v ^? key "status" . _String
+      <*> v ^? key "gasUsed" . quantity
+      <*> v ^? key "logsBloom" . _String
+
+-- | Up to the given number of the most recent transactions, walking back from
+-- the latest block. Looks at no more than 100 blocks, since clique and PoW
+-- chains seal empty blocks.
+recentTxIds :: MonadIO m => Geth -> Int -> m (Either Text [TxId])
+recentTxIds geth n = blockNumber geth >>= either (pure . Left) start
+  where
+    maxBlocks = 100
+
+    start latest = collect [] (max 1 (latest - maxBlocks + 1)) latest
+
+    collect :: MonadIO m => [TxId] -> Int -> Int -> m (Either Text [TxId])
+    collect acc earliest num
+      | length acc >= n || num < earliest = pure $ Right $ take n acc
+      | otherwise = do
+        result <- rpcRequest geth txHashes "eth_getBlockByNumber"
+          [toJSON (format ("0x"%x) num), toJSON False]
+        either (pure . Left)
+               (\tids -> collect (acc <> tids) earliest (num - 1))
+               result
+
+    txHashes :: Fold Value [TxId]
+    txHashes = to $ toListOf $ key "transactions" . values . _String
+      . to textToBytes32 . traverse . to TxId
+
+-- | Removes a node from the cluster via an existing member, stops it, and
+-- archives its datadir to the given directory. The node's constellation, if
+-- any, is left running, so its storage is left out of the archive.
+decommissionNode :: MonadIO m
+                 => Geth
+                 -> (Geth, NodeInstrumentation)
+                 -> FilePath
+                 -> m (Either Text FilePath)
+decommissionNode member (target, instruments) archiveDir = do
+  removed <- removeNode member (gethId target)
+  liftIO $ for removed $ \() -> do
+    killNode instruments
+    void $ wait $ nodeTerminated instruments
+    archiveDataDir constellationRuntimePaths (gethDataDir target) archiveDir
+
 sendEmptyTx :: MonadIO io => Geth -> io ()
 sendEmptyTx geth = liftIO $ void $
   post (T.unpack (gethUrl geth)) (emptyTxRpcBody geth)
@@ -203,6 +368,7 @@ spamBody :: SpamMode -> Geth -> Value
 spamBody = \case
   SpamEmptyTx -> emptyTxRpcBody
   SpamTx args -> sendBody args
+  SpamPayload size privacy -> payloadBody size privacy
 
 bench :: MonadIO m => SpamMode -> Geth -> Seconds -> m ()
 bench spamMode geth (Seconds seconds) = view benchShell
@@ -239,9 +405,14 @@ spamGeth monitor spamMode rateLimit geth = do
   liftIO $ Sess.withSessionControl Nothing defaultManagerSettings $ \sess -> do
     let gUrl = T.unpack $ gethUrl geth
 
+        -- wreq throws for non-2xx responses, e.g. a payload too large for
+        -- geth to accept, which we count as rejections
         postBody :: Value -> IO (Either Text TxId)
         postBody val = Metrics.log monitor (Metrics.SendTx sendState) $
-          extractTxId <$> Sess.post sess gUrl val
+          either httpFailure extractTxId <$> try (Sess.post sess gUrl val)
+
+        httpFailure :: HttpException -> Either Text TxId
+        httpFailure = Left . T.pack . show
 
         txBody = spamBody spamMode geth
     waitThenPost <- generateRateLimitedFunction rateLimit postBody dontCombine
@@ -16,27 +16,30 @@ import           Control.Concurrent.Async   (cancel, forConcurrently,
 import qualified Control.Foldl              as Fold
 import           Control.Lens               (at, has, ix, over, to, toListOf,
                                              view, (^.), (^?), (.~))
-import           Control.Monad              (replicateM)
+import           Control.Monad              (guard, replicateM)
 import           Control.Monad.Except       (MonadError, throwError,
                                              runExceptT)
 import           Control.Monad.Managed      (MonadManaged)
 import           Control.Monad.Reader       (ReaderT (runReaderT))
 import           Control.Monad.Reader.Class (MonadReader (ask))
+import           Crypto.Hash                (Digest, SHA256, hashlazy)
 import           Data.Aeson                 (Value, withObject, (.:))
 import           Data.Aeson.Types           (parseMaybe)
 import qualified Data.Aeson.Types           as Aeson
 import           Data.Bool                  (bool)
 import qualified Data.ByteString.Char8      as B8
-import           Data.Foldable              (toList)
+import qualified Data.ByteString.Lazy       as LBS
+import           Data.Foldable              (toList, traverse_)
 import           Data.Map.Strict            (Map)
 import qualified Data.Map.Strict            as Map
-import           Data.Maybe                 (fromMaybe)
+import           Data.Maybe                 (fromMaybe, isJust)
 import           Data.Monoid                (First (..))
 import           Data.Semigroup             ((<>))
 import qualified Data.Set                   as Set
 import           Data.Text                  (Text, replace)
 import qualified Data.Text                  as T
 import           Data.Text.Encoding         (decodeUtf8, encodeUtf8)
+import           Data.Time.Clock            (UTCTime)
 import           Data.Traversable           (for)
 import           Prelude                    hiding (FilePath, lines)
 import           Safe                       (atMay, headMay)
@@ -47,6 +50,7 @@ import           URI.ByteString             (parseURI, serializeURIRef',
                                              queryPairsL)
 
 import           QuorumTools.Constellation  (constellationConfPath,
+                                             installTlsCerts,
                                              setupConstellationNode)
 import           QuorumTools.Control
 import           QuorumTools.Genesis        (createGenesisJson)
@@ -71,11 +75,18 @@ emptyClusterEnv = ClusterEnv
   , _clusterDataDirs              = Map.empty
   , _clusterConstellationConfs    = Map.empty
   , _clusterAccountKeys           = Map.empty
+  , _clusterNodeKeys              = Map.empty
+  , _clusterConstellationKeys     = Map.empty
+  , _clusterConstellationTls      = Nothing
+  , _clusterConstellationCerts    = Map.empty
+  , _clusterExtraGethArgs         = Map.empty
+  , _clusterGethEnvironment       = Map.empty
   , _clusterInitialMembers        = Set.empty
   , _clusterInitialBalances       = Map.empty
   , _clusterConsensusConfig       = RaftConfig { _raftBasePort = 50400 }
   , _clusterMode                  = QuorumMode
   , _clusterPrivacySupport        = PrivacyDisabled
+  , _clusterTimeoutScale          = 1
   }
 
 envAccountKeys :: ClusterEnv -> [AccountId]
@@ -102,6 +113,18 @@ usingConsensus Clique env = env
   & clusterMode            .~ EthereumMode
   & withInitialBalances
 
+-- | Restricts the clique signers to the given nodes, so that the rest of the
+-- cluster only follows the chain. Other consensus configs are left untouched.
+withCliqueSigners :: [GethId] -> ClusterEnv -> ClusterEnv
+withCliqueSigners gids env = env
+    & clusterConsensusConfig . cliqueSigners .~ signers
+
+  where
+    signers = [ key ^. akAccountId
+              | (gid, key) <- Map.toList (env ^. clusterAccountKeys)
+              , gid `elem` gids
+              ]
+
 mkClusterEnv :: (GethId -> Ip)
              -> (GethId -> DataDir)
              -> Map GethId AccountKey
@@ -168,34 +191,42 @@ bootnodeEnode :: EnodeId
 bootnodeEnode = EnodeId "enode://61077a284f5ba7607ab04f33cfde2750d659ad9af962516e159cf6ce708646066cd927a900944ce393b98b95c914e4d6c54b099f568342647a1cd4a262cc0423@[127.0.0.1]:33445"
 
 gethCommand :: Geth -> Text -> Text
-gethCommand geth more = format (s%" geth --datadir "%fp                    %
-                                       " --port "%d                        %
-                                       " --rpcport "%d                     %
-                                       " --networkid "%d                   %
-                                       " --verbosity "%d                   %
-                                       " --nodiscover"                     %
-                                       " --rpc"                            %
-                                       " --rpccorsdomain '*'"              %
-                                       " --rpcaddr localhost"              %
-                                       " --rpcapi eth,net,web3,raft,admin" %
-                                       " --emitcheckpoints"                %
-                                       " --unlock 0"                       %
-                                       " --password /dev/null"             %
+gethCommand geth more = format (s%" geth --datadir "%fp                                 %
+                                       " --port "%d                                     %
+                                       " --rpcport "%d                                  %
+                                       " --networkid "%d                                %
+                                       " --verbosity "%d                                %
+                                       " --nodiscover"                                  %
+                                       " --rpc"                                         %
+                                       " --rpccorsdomain '*'"                           %
+                                       " --rpcaddr localhost"                           %
+                                       " --rpcapi eth,net,web3,raft,admin,debug,txpool" %
+                                       " --emitcheckpoints"                             %
+                                       " --unlock 0"                                    %
+                                       " --password /dev/null"                          %
+                                       " "%s%
                                        " "%s%
                                        " "%s)
-                          envVar
+                          envVars
                           (dataDirPath (gethDataDir geth))
                           (gethHttpPort geth)
                           (gethRpcPort geth)
                           (gethNetworkId geth)
                           (gethVerbosity geth)
                           (consensusOptions (gethConsensusPeer geth))
+                          (T.unwords (gethExtraArgs geth))
                           more
   where
-    envVar :: Text
-    envVar = case gethConstellationConfig geth of
-      Just conf -> "PRIVATE_CONFIG=" <> format fp conf
-      Nothing   -> ""
+    envVars :: Text
+    envVars = T.unwords $ envVar <$> privateConfig <> gethEnvironment geth
+
+    envVar :: (Text, Text) -> Text
+    envVar (name, val) = format (s%"='"%s%"'") name (shellEscapeSingleQuotes val)
+
+    privateConfig :: [(Text, Text)]
+    privateConfig = case gethConstellationConfig geth of
+      Just conf -> [("PRIVATE_CONFIG", format fp conf)]
+      Nothing   -> []
 
     consensusOptions :: ConsensusPeer -> Text
     consensusOptions (RaftPeer port) = case gethJoinMode geth of
@@ -203,7 +234,8 @@ gethCommand geth more = format (s%" geth --datadir "%fp                    %
                                (gId $ gethId geth)
                                port
         JoinNewCluster -> format ("--raft --raftport "%d) port
-    consensusOptions CliquePeer = "--mine"
+    consensusOptions (CliquePeer CliqueSigner) = "--mine"
+    consensusOptions (CliquePeer CliqueFollower) = ""
     consensusOptions PowPeer = "--mine"
 
 initNode :: (MonadIO m, MonadError ProvisionError m, HasEnv m)
@@ -239,14 +271,19 @@ findAccountKey dir acctId = do
     fmap (AccountKey acctId) <$> sequence (strict . input <$> mPath)
 
 readAccountKey :: MonadIO m => DataDir -> GethId -> m AccountKey
-readAccountKey (DataDir ddPath) gid = do
+readAccountKey (DataDir ddPath) gid = loadAccountKey keyPath
+  where
+    keyPath = ddPath </> "keystore" </> fromText (nodeName gid)
+
+-- | Loads an account key from any keystore file, e.g. one kept alongside test
+-- fixtures so that the account ID is the same from run to run.
+loadAccountKey :: MonadIO m => FilePath -> m AccountKey
+loadAccountKey keyPath = do
     keyContents <- strict $ input keyPath
     let acctId = forceAcctId $ parseMaybe aidParser =<< textDecode keyContents
     pure $ AccountKey acctId keyContents
 
   where
-    keyPath = ddPath </> "keystore" </> fromText (nodeName gid)
-
     aidParser :: Value -> Aeson.Parser AccountId
     aidParser = withObject "AccountId" $ \obj ->
       AccountId . Addr <$> obj .: "address"
@@ -334,7 +371,8 @@ addRaftPort (Port port) (EnodeId url) = EnodeId
 mkConsensusPeer :: GethId -> AccountId -> ConsensusConfig -> ConsensusPeer
 mkConsensusPeer gid _ (RaftConfig basePort) =
   RaftPeer $ basePort + fromIntegral (gId gid)
-mkConsensusPeer _ _ (CliqueConfig _) = CliquePeer
+mkConsensusPeer _ aid (CliqueConfig signers) = CliquePeer $
+  bool CliqueFollower CliqueSigner (aid `elem` signers)
 mkConsensusPeer _ _  PowConfig = PowPeer
 
 mkGeth :: (MonadIO m, HasEnv m) => GethId -> EnodeId -> m Geth
@@ -365,6 +403,8 @@ mkGeth gid eid = do
                    PrivacyEnabled -> Just $ constellationConfPath datadir
                    PrivacyDisabled -> Nothing)
                 (view clusterPrivacySupport)
+       <*> view (clusterExtraGethArgs . ix gid)
+       <*> view (clusterGethEnvironment . ix gid)
 
 installAccountKey :: (MonadIO m, HasEnv m) => GethId -> AccountKey -> m ()
 installAccountKey gid acctKey = do
@@ -373,6 +413,15 @@ installAccountKey gid acctKey = do
       jsonPath = keystoreDir </> fromText (nodeName gid)
   output jsonPath (select $ textToLines $ _akKey acctKey)
 
+-- | Installs an existing nodekey so that geth doesn't generate a fresh one
+-- (and a fresh enode ID) when it first starts.
+installNodeKey :: (MonadIO m, HasEnv m) => GethId -> FilePath -> m ()
+installNodeKey gid keyPath = do
+  dir <- gidDataDir gid
+  let gethDir = dataDirPath dir </> "geth"
+  mktree gethDir
+  cp keyPath (gethDir </> "nodekey")
+
 createNode :: (MonadIO m, MonadError ProvisionError m, HasEnv m)
            => FilePath
            -> GethId
@@ -382,6 +431,7 @@ createNode genesisJsonPath gid = do
     cEnv <- ask
     let acctKey = forceAcctKey $ cEnv ^? clusterAccountKeys . ix gid
     installAccountKey gid acctKey
+    traverse_ (installNodeKey gid) $ cEnv ^? clusterNodeKeys . ix gid
     -- The following enode ID from geth does *not* contain a raft port, ever.
     -- TODO: we should fix this on the geth side, which is nontrivial for now
     -- TODO: in order to help simplify the fix this on the geth side, we should
@@ -434,22 +484,44 @@ readEnodeId gid = do
     forceEnodeId = fromMaybe $ error $
       "enode ID not found in list for " <> show gid
 
+-- | Loads the geths of an existing local cluster of the given size from their
+-- datadirs under @gdata@, along with the env they were loaded in.
+loadLocalCluster :: MonadIO m
+                 => PrivacySupport
+                 -> Int
+                 -> m (ClusterEnv, [Geth])
+loadLocalCluster privacySupport size = do
+    keys <- Map.traverseWithKey (flip readAccountKey) dataDirs
+    let cEnv = mkLocalEnv keys Raft
+             & clusterPrivacySupport .~ privacySupport
+    geths <- runReaderT (traverse loadGeth gids) cEnv
+    pure (cEnv, geths)
+
+  where
+    gids          = clusterGids size
+    mkDataDir gid = DataDir $ "gdata" </> fromText (nodeName gid)
+    dataDirs      = Map.fromList $ zip gids (mkDataDir <$> gids)
+    loadGeth gid  = mkGeth gid =<< readEnodeId gid
+
 -- TODO: probably refactor this to take a Geth, not GethId? (don't use HasEnv)
 -- TODO: then move the function to QuorumTools.Constellation
 mkConstellationConfig :: HasEnv m => GethId -> m ConstellationConfig
 mkConstellationConfig thisGid = do
     otherPeers <- filter (/= thisGid) . toList <$> view clusterInitialMembers
+    tls <- view clusterConstellationTls
 
-    ConstellationConfig <$> constellationUrl thisGid
+    ConstellationConfig <$> constellationUrl tls thisGid
                         <*> gidDataDir thisGid
                         <*> constellationPort thisGid
-                        <*> traverse constellationUrl otherPeers
+                        <*> traverse (constellationUrl tls) otherPeers
+                        <*> pure tls
   where
-    constellationUrl :: HasEnv m => GethId -> m Text
-    constellationUrl gid = do
+    constellationUrl :: HasEnv m => Maybe ConstellationTls -> GethId -> m Text
+    constellationUrl tls gid = do
       ip <- gidIp gid
       port <- constellationPort gid
-      pure $ format ("http://"%s%":"%d%"/") (getIp ip) port
+      let scheme = maybe "http" (const "https") tls :: Text
+      pure $ format (s%"://"%s%":"%d%"/") scheme (getIp ip) port
 
 setupNodes :: (MonadIO m, HasEnv m) => Maybe DataDir -> [GethId] -> m [Geth]
 setupNodes deployDatadir gids = do
@@ -474,7 +546,10 @@ setupNodes deployDatadir gids = do
   when (privacySupport == PrivacyEnabled) $
     void $ liftIO $ forConcurrently gids $ \gid -> do
       constConf <- runReaderT (mkConstellationConfig gid) clusterEnv
-      setupConstellationNode deployDatadir constConf
+      let keyPair = clusterEnv ^? clusterConstellationKeys . ix gid
+      setupConstellationNode deployDatadir keyPair constConf
+      traverse_ (installTlsCerts (ccDataDir constConf)) $
+        clusterEnv ^? clusterConstellationCerts . ix gid
 
   pure geths
 
@@ -494,6 +569,92 @@ wipeAndSetupNodes deployDatadir rootDir gids = do
   wipeLocalClusterRoot rootDir
   setupNodes deployDatadir gids
 
+-- | Archives a stopped node's datadir (chain data, keys and constellation
+-- storage) to a gzipped tarball in the given directory, and writes its SHA-256
+-- checksum alongside in @sha256sum@ format. Returns the tarball's path. Paths
+-- relative to the datadir can be left out, e.g.
+-- 'QuorumTools.Constellation.constellationRuntimePaths' when the node's
+-- constellation is still running.
+archiveDataDir :: MonadIO m => [FilePath] -> DataDir -> FilePath -> m FilePath
+archiveDataDir excluded (DataDir ddPath) archiveDir = do
+    mktree archiveDir
+    shells (format ("tar -czf "%fp%" -C "%fp%" "%s%" "%fp)
+                   archivePath
+                   (directory ddPath)
+                   (T.unwords $ exclude <$> excluded)
+                   (filename ddPath))
+           empty
+
+    digest <- liftIO $ sha256 <$> LBS.readFile (encodeString archivePath)
+    writeTextFile (archivePath <.> "sha256") $
+      format (w%"  "%fp%"\n") digest (filename archivePath)
+
+    return archivePath
+
+  where
+    archivePath = archiveDir </> filename ddPath <.> "tar.gz"
+    exclude path = format ("--exclude="%fp) (filename ddPath </> path)
+
+-- | Replaces a stopped node's datadir with the contents of a tarball written by
+-- 'archiveDataDir', after checking it against its checksum. Because the
+-- node's keys are restored along with its chain data, the node comes back with
+-- the same enode ID and constellation public key.
+restoreDataDir :: MonadIO m => FilePath -> DataDir -> m (Either Text ())
+restoreDataDir archivePath (DataDir ddPath) = do
+    expected <- T.takeWhile (/= ' ') <$> readTextFile (archivePath <.> "sha256")
+    digest <- liftIO $ sha256 <$> LBS.readFile (encodeString archivePath)
+
+    if format w digest /= expected
+    then return $ Left $ format ("checksum mismatch for "%fp) archivePath
+    else do
+      exists <- testdir ddPath
+      when exists $ rmtree ddPath
+      mktree ddPath
+      shells (format ("tar -xzf "%fp%" -C "%fp%" --strip-components=1")
+                     archivePath
+                     ddPath)
+             empty
+      return $ Right ()
+
+sha256 :: LBS.ByteString -> Digest SHA256
+sha256 = hashlazy
+
+gethLogPath :: GethId -> FilePath
+gethLogPath gid = fromText $ nodeName gid <> ".out"
+
+-- | Matches the names of 'gethLogPath' and
+-- 'QuorumTools.Constellation.constellationLogPath'
+isLogFile :: FilePath -> Bool
+isLogFile path = isJust $ matchOnce logName $ format fp $ filename path
+  where
+    logName :: Pattern Int
+    logName = ("geth" <|> "constellation") *> decimal <* ".out"
+
+-- | Bundles the geth and constellation logs written to the working directory
+-- since the given time into a gzipped tarball, e.g. to keep them around after
+-- a failed test. This picks up nodes started partway through a test, but not
+-- stale logs from earlier runs. Returns 'Nothing' if there are no such logs.
+archiveLogs :: MonadIO m => UTCTime -> FilePath -> m (Maybe FilePath)
+archiveLogs since archivePath = do
+  logs <- fold recentLogs Fold.list
+  if null logs
+  then return Nothing
+  else do
+    mktree $ directory archivePath
+    shells (format ("tar -czf "%fp%" "%s)
+                   archivePath
+                   (T.unwords $ format fp <$> logs))
+           empty
+    return $ Just archivePath
+
+  where
+    recentLogs = do
+      path <- ls "."
+      guard $ isLogFile path
+      modified <- datefile path
+      guard $ modified >= since
+      return path
+
 gethShell :: Geth -> Shell Line
 gethShell geth = do
   pwPath <- using $ fileContaining $ select $ textToLines $
@@ -521,7 +682,7 @@ runNode numInitialNodes geth = do
     -- with the HTTP transport, each node actually even connects to itself
     if Set.size peers == numInitialNodes then Just () else Nothing
 
-  let logPath = fromText $ nodeName (gethId geth) <> ".out"
+  let logPath = gethLogPath $ gethId geth
       instrumentedLines
         = gethShell geth
         & tee logPath
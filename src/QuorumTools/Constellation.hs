@@ -1,3 +1,4 @@
+{-# LANGUAGE FlexibleContexts    #-}
 {-# LANGUAGE NamedFieldPuns      #-}
 {-# LANGUAGE OverloadedStrings   #-}
 {-# LANGUAGE ScopedTypeVariables #-}
@@ -7,6 +8,7 @@ module QuorumTools.Constellation where
 import           Constellation.Enclave.Key (b64EncodePublicKey,
                                             jsonEncodePrivateKey, newKeyPair)
 import           Control.Concurrent        (threadDelay)
+import           Control.Lens              (view)
 import           Control.Monad             (forM_)
 import           Control.Monad.Managed     (MonadManaged)
 import qualified Data.ByteString.Lazy      as LBS
@@ -14,7 +16,7 @@ import           Data.Maybe                (fromMaybe)
 import           Data.Text                 (Text)
 import           Data.Text.Encoding        (decodeUtf8)
 import           Prelude                   hiding (FilePath, lines)
-import           Turtle                    hiding (f)
+import           Turtle                    hiding (f, view)
 
 import           QuorumTools.Types
 import           QuorumTools.Util          (inshellWithJoinedErr, tee)
@@ -22,20 +24,46 @@ import           QuorumTools.Util          (inshellWithJoinedErr, tee)
 constellationConfPath :: DataDir -> FilePath
 constellationConfPath (DataDir ddPath) = ddPath </> "constellation.toml"
 
+publicKeyPath :: DataDir -> FilePath
+publicKeyPath (DataDir ddPath) = ddPath </> "keys" </> "constellation.pub"
+
+privateKeyPath :: DataDir -> FilePath
+privateKeyPath (DataDir ddPath) = ddPath </> "keys" </> "constellation.key"
+
 generateKeyPair :: MonadIO m => DataDir -> m ()
 generateKeyPair datadir = liftIO $ do
     (pub, priv) <- newKeyPair
-    mktree keyDir
+    mktree $ directory $ publicKeyPath datadir
     let pubText = decodeUtf8 $ b64EncodePublicKey pub
-    writeTextFile pubFile pubText
+    writeTextFile (publicKeyPath datadir) pubText
     privText <- decodeUtf8 . LBS.toStrict <$> jsonEncodePrivateKey passwd priv
-    writeTextFile keyFile privText
+    writeTextFile (privateKeyPath datadir) privText
 
   where
-    passwd  = Nothing
-    keyDir  = dataDirPath datadir </> "keys"
-    pubFile = keyDir </> "constellation.pub"
-    keyFile = keyDir </> "constellation.key"
+    passwd = Nothing
+
+-- | Copies an existing key pair into a datadir, in place of 'generateKeyPair'
+installKeyPair :: MonadIO m => DataDir -> ConstellationKeyPair -> m ()
+installKeyPair datadir (ConstellationKeyPair pubPath privPath) = do
+  mktree $ directory $ publicKeyPath datadir
+  cp pubPath (publicKeyPath datadir)
+  cp privPath (privateKeyPath datadir)
+
+tlsDir :: DataDir -> FilePath
+tlsDir (DataDir ddPath) = ddPath </> "tls"
+
+-- | The certificates and keys for TLS in a node's 'tlsDir'
+tlsFiles :: [FilePath]
+tlsFiles = [ "server-cert.pem", "server-key.pem"
+           , "client-cert.pem", "client-key.pem"
+           ]
+
+-- | Copies existing certificates into a datadir, so constellation uses them
+-- instead of generating its own
+installTlsCerts :: MonadIO m => DataDir -> FilePath -> m ()
+installTlsCerts datadir certDir = do
+  mktree $ tlsDir datadir
+  forM_ tlsFiles $ \file -> cp (certDir </> file) (tlsDir datadir </> file)
 
 -- | Writes the constellation config to a deploy datadir, or its datadir
 installConfig :: MonadIO io => Maybe DataDir -> ConstellationConfig -> io ()
@@ -48,10 +76,11 @@ installConfig mDeployDataDir conf = liftIO $ writeTextFile path contents
 
 setupConstellationNode :: MonadIO io
                        => Maybe DataDir
+                       -> Maybe ConstellationKeyPair
                        -> ConstellationConfig
                        -> io ()
-setupConstellationNode deployDataDir conf = do
-    generateKeyPair localDataDir
+setupConstellationNode deployDataDir mKeyPair conf = do
+    maybe (generateKeyPair localDataDir) (installKeyPair localDataDir) mKeyPair
     installConfig deployDataDir conf
 
   where
@@ -67,22 +96,29 @@ startConstellationNode geth =
 
     confPath = forceConfigPath $ gethConstellationConfig geth
     command = format ("constellation-node -v "%fp) confPath
-    logPath = fromText $ format ("constellation"%d%".out") (gId $ gethId geth)
+    logPath = constellationLogPath $ gethId geth
+
+constellationLogPath :: GethId -> FilePath
+constellationLogPath gid =
+  fromText $ format ("constellation"%d%".out") (gId gid)
 
-startConstellationNodes :: (Foldable f, MonadManaged io) => f Geth -> io ()
+startConstellationNodes :: (Foldable f, MonadManaged io, HasEnv io)
+                        => f Geth
+                        -> io ()
 startConstellationNodes geths = do
   forM_ geths startConstellationNode
   --
   -- TODO: connect to constellations via http instead of this:
   --
-  liftIO $ threadDelay 1000000
+  scale <- view clusterTimeoutScale
+  liftIO $ threadDelay $ scale * 1000000
 
 -- We parameterize by a DataDir here so that we can handle the case of
 -- bootstrapping a cluster (eg for AWS) -- where the datadir is located in a
 -- different place on the filesystem.
 confText :: DataDir -> ConstellationConfig -> Text
-confText (DataDir ddPath) conf =
-  let ConstellationConfig {ccUrl, ccPort, ccOtherNodes} = conf
+confText datadir@(DataDir ddPath) conf =
+  let ConstellationConfig {ccUrl, ccPort, ccOtherNodes, ccTls} = conf
 
       lf :: Format r r
       lf = "\n"
@@ -99,11 +135,47 @@ confText (DataDir ddPath) conf =
         "privateKeyPath = "%quote fp%lf%
         "storagePath = "%quote fp%lf
 
+      tlsTemplate =
+        "tls = \"strict\""%lf%
+        "tlsservercert = "%quote fp%lf%
+        "tlsserverkey = "%quote fp%lf%
+        "tlsserverchain = []"%lf%
+        "tlsservertrust = "%quote s%lf%
+        "tlsknownclients = "%quote fp%lf%
+        "tlsclientcert = "%quote fp%lf%
+        "tlsclientkey = "%quote fp%lf%
+        "tlsclientchain = []"%lf%
+        "tlsclienttrust = "%quote s%lf%
+        "tlsknownservers = "%quote fp%lf
+
+      tlsSection = case ccTls of
+        Nothing -> ""
+        Just (ConstellationTls serverTrust clientTrust) -> format tlsTemplate
+          (tlsDir datadir </> "server-cert.pem")
+          (tlsDir datadir </> "server-key.pem")
+          (trustText serverTrust)
+          (tlsDir datadir </> "known-clients")
+          (tlsDir datadir </> "client-cert.pem")
+          (tlsDir datadir </> "client-key.pem")
+          (trustText clientTrust)
+          (tlsDir datadir </> "known-servers")
+
   in format template
             ccUrl
             ccPort
             (ddPath </> "constellation.ipc")
             ccOtherNodes
-            (ddPath </> "keys" </> "constellation.pub")
-            (ddPath </> "keys" </> "constellation.key")
+            (publicKeyPath datadir)
+            (privateKeyPath datadir)
             (ddPath </> "constellation")
+     <> tlsSection
+
+-- | What constellation writes to in its datadir while it runs (its storage
+-- and IPC socket), relative to the datadir
+constellationRuntimePaths :: [FilePath]
+constellationRuntimePaths = ["constellation", "constellation.ipc"]
+
+trustText :: TlsTrust -> Text
+trustText TrustTofu         = "tofu"
+trustText TrustCaOrTofu     = "ca-or-tofu"
+trustText TrustNoValidation = "insecure-no-validation"
@@ -21,15 +21,17 @@ createGenesisJson = do
     jsonPath <- view clusterGenesisJson
     balances <- view clusterInitialBalances
     mode <- view clusterMode
-    output jsonPath (contents balances consensusCfg mode)
+    scale <- view clusterTimeoutScale
+    output jsonPath (contents balances consensusCfg mode scale)
     return jsonPath
 
   where
     contents :: Map AccountId Integer
              -> ConsensusConfig
              -> ClusterMode
+             -> Int
              -> Shell Line
-    contents bals consenCfg mode = select $ textToLines $ textEncode $ object
+    contents bals consenCfg mode scale = select $ textToLines $ textEncode $ object
       [ "alloc"      .= (object $
         map (\(ai, bal) ->
               accountIdToText ai .= object ["balance" .= T.pack (show bal)])
@@ -46,7 +48,7 @@ createGenesisJson = do
          ] <> case consenCfg of
                 RaftConfig _ -> []
                 CliqueConfig _ -> [ "clique" .= object
-                                    [ "period" .= i 1
+                                    [ "period" .= i scale
                                     , "epoch"  .= i 30000
                                     ]
                                   ]
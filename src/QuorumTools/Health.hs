@@ -0,0 +1,192 @@
+{-# LANGUAGE FlexibleContexts  #-}
+{-# LANGUAGE LambdaCase        #-}
+{-# LANGUAGE OverloadedStrings #-}
+{-# LANGUAGE TupleSections     #-}
+
+-- | Health checks for each of the processes backing a node. Geth and its
+-- constellation node are checked independently, so that a failure in one is
+-- not mistaken for a failure of the whole node.
+module QuorumTools.Health
+  ( Component (..)
+  , Health (..)
+  , ComponentHealth (..)
+  , NodeHealth (..)
+  , checkGeth
+  , checkConstellation
+  , nodeHealth
+  , verifyGeth
+  , verifyCluster
+  , isHealthy
+  , printNodeHealth
+  ) where
+
+import           Control.Concurrent        (threadDelay)
+import           Control.Exception         (try)
+import           Control.Lens              (view)
+import           Data.Foldable             (for_, toList)
+import qualified Data.Text                 as T
+import           Network.HTTP.Client       (HttpException)
+import           Network.Wreq              (get)
+import           Prelude                   hiding (FilePath)
+import           Turtle                    hiding (view)
+
+import           QuorumTools.Client        (blockNumber, peerCount, raftRole)
+import           QuorumTools.Cluster       (mkConstellationConfig, nodeName)
+import           QuorumTools.Constellation (tlsDir)
+import           QuorumTools.Types
+
+data Component
+  = GethComponent
+  | ConstellationComponent
+  deriving (Eq, Show)
+
+data Health
+  = Healthy
+  | Unhealthy Text -- the error from the most recent attempt
+  deriving (Eq, Show)
+
+-- | The outcome of each named check performed against a single component.
+data ComponentHealth = ComponentHealth
+  { chComponent :: Component
+  , chChecks    :: [(Text, Health)]
+  } deriving (Eq, Show)
+
+data NodeHealth = NodeHealth
+  { nhGethId        :: GethId
+  , nhGeth          :: ComponentHealth
+  , nhConstellation :: Maybe ComponentHealth -- Nothing without privacy
+  } deriving (Eq, Show)
+
+-- | Runs a check, treating a refused connection like any other failure.
+runCheck :: MonadIO m => (Text, IO (Either Text ())) -> m (Text, Health)
+runCheck (name, action) = liftIO $ (name,) . toHealth <$> try action
+  where
+    toHealth :: Either HttpException (Either Text ()) -> Health
+    toHealth = \case
+      Left err         -> Unhealthy $ T.pack $ show err
+      Right (Left msg) -> Unhealthy msg
+      Right (Right ()) -> Healthy
+
+checkGeth :: MonadIO m => Geth -> m ComponentHealth
+checkGeth geth = ComponentHealth GethComponent <$> traverse runCheck
+    [ ("rpc",   void <$> blockNumber geth)
+    , ("peers", (>>= hasPeers) <$> peerCount geth)
+    ]
+
+  where
+    hasPeers :: Int -> Either Text ()
+    hasPeers 0 = Left "no connected peers"
+    hasPeers _ = Right ()
+
+checkConstellation :: MonadIO m => ConstellationConfig -> m ComponentHealth
+checkConstellation conf = ComponentHealth ConstellationComponent <$>
+    traverse runCheck [("upcheck", upcheck)]
+
+  where
+    url = ccUrl conf <> "upcheck"
+
+    upcheck :: IO (Either Text ())
+    upcheck = case ccTls conf of
+      -- wreq throws for any non-2xx response
+      Nothing -> Right () <$ get (T.unpack url)
+      -- With TLS we present the node's own client certificate, in case peers
+      -- are verified, and skip verifying its (likely self-signed) server one.
+      Just _ -> do
+        let certDir = tlsDir (ccDataDir conf)
+        (exitCode, _, err) <- shellStrictWithErr
+          (format ("curl -sSfk --cert "%fp%" --key "%fp%" "%s)
+                  (certDir </> "client-cert.pem")
+                  (certDir </> "client-key.pem")
+                  url)
+          empty
+        pure $ case exitCode of
+          ExitSuccess   -> Right ()
+          ExitFailure _ -> Left err
+
+-- | A stricter check for a freshly started cluster: geth must be connected to
+-- at least the given number of peers, and consensus must be under way.
+verifyGeth :: MonadIO m => Int -> Geth -> m ComponentHealth
+verifyGeth numPeers geth = ComponentHealth GethComponent <$> traverse runCheck
+    [ ("rpc",       void <$> blockNumber geth)
+    , ("peers",     (>>= expectPeers) <$> peerCount geth)
+    , ("consensus", consensusStarted)
+    ]
+
+  where
+    expectPeers :: Int -> Either Text ()
+    expectPeers n
+      | n >= numPeers = Right ()
+      | otherwise     = Left $ format ("connected to "%d%" of "%d%" peers")
+                                      n
+                                      numPeers
+
+    -- raft only mints blocks for new transactions, so we look for an elected
+    -- role instead of a block
+    consensusStarted :: IO (Either Text ())
+    consensusStarted = case gethConsensusPeer geth of
+      RaftPeer _ -> (>>= hasRole) <$> raftRole geth
+      CliquePeer _ -> (>>= hasBlocks) <$> blockNumber geth
+      PowPeer    -> (>>= hasBlocks) <$> blockNumber geth
+
+    hasRole :: Text -> Either Text ()
+    hasRole role
+      | role `elem` ["minter", "verifier"] = Right ()
+      | otherwise = Left $ "no raft role assumed (" <> role <> ")"
+
+    hasBlocks :: Int -> Either Text ()
+    hasBlocks 0 = Left "no blocks produced"
+    hasBlocks _ = Right ()
+
+-- | Polls every node once a second until all of them pass 'verifyGeth' (and
+-- constellation checks, with privacy enabled), or until the attempts run out.
+-- Returns the last report for every node.
+verifyCluster :: (MonadIO m, HasEnv m) => Int -> [Geth] -> m [NodeHealth]
+verifyCluster attempts geths = do
+    healths <- traverse (nodeHealthWith (verifyGeth numPeers)) geths
+    if all isHealthy healths || attempts <= 1
+    then pure healths
+    else do
+      liftIO $ threadDelay 1000000
+      verifyCluster (attempts - 1) geths
+
+  where
+    numPeers = length geths - 1
+
+nodeHealth :: (MonadIO m, HasEnv m) => Geth -> m NodeHealth
+nodeHealth = nodeHealthWith checkGeth
+
+nodeHealthWith :: (MonadIO m, HasEnv m)
+               => (Geth -> m ComponentHealth)
+               -> Geth
+               -> m NodeHealth
+nodeHealthWith checkGeth' geth = do
+  privacySupport <- view clusterPrivacySupport
+  gethHealth <- checkGeth' geth
+  constellationHealth <- case privacySupport of
+    PrivacyEnabled -> fmap Just . checkConstellation
+      =<< mkConstellationConfig (gethId geth)
+    PrivacyDisabled -> pure Nothing
+
+  pure $ NodeHealth (gethId geth) gethHealth constellationHealth
+
+isHealthy :: NodeHealth -> Bool
+isHealthy (NodeHealth _ gethHealth constellationHealth) =
+  all ((== Healthy) . snd) $
+    concatMap chChecks (gethHealth : toList constellationHealth)
+
+printNodeHealth :: MonadIO m => NodeHealth -> m ()
+printNodeHealth (NodeHealth gid gethHealth constellationHealth) = do
+    printf (s%"\n") (nodeName gid)
+    for_ (gethHealth : toList constellationHealth) $
+      \(ComponentHealth component checks) -> for_ checks $ \(name, health) ->
+        printf ("  "%s%" "%s%": "%s%"\n")
+               (componentName component)
+               name
+               (describe health)
+
+  where
+    componentName GethComponent          = "geth"
+    componentName ConstellationComponent = "constellation"
+
+    describe Healthy         = "ok"
+    describe (Unhealthy err) = "failing (" <> err <> ")"
@@ -0,0 +1,29 @@
+{-# LANGUAGE OverloadedStrings #-}
+
+-- | Reports the health of each node in an existing cluster, checking geth and
+-- constellation separately.
+module QuorumTools.Mains.LocalHealth where
+
+import           Control.Monad.Reader      (runReaderT)
+import           Turtle                    hiding (view)
+
+import           QuorumTools.Cluster       (loadLocalCluster)
+import           QuorumTools.Health
+import           QuorumTools.Options       (clusterSizeP)
+import           QuorumTools.Types
+
+newtype LocalHealthConfig = LocalHealthConfig { clusterSize :: Int }
+
+cliParser :: Parser LocalHealthConfig
+cliParser = LocalHealthConfig <$> clusterSizeP
+
+localHealthMain :: IO ()
+localHealthMain = do
+    config <- options "Reports the health of a local cluster" cliParser
+
+    (cEnv, geths) <- loadLocalCluster PrivacyEnabled (clusterSize config)
+
+    healths <- runReaderT (traverse nodeHealth geths) cEnv
+    mapM_ printNodeHealth healths
+
+    unless (all isHealthy healths) $ exit (ExitFailure 1)
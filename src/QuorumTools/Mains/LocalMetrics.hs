@@ -0,0 +1,98 @@
+{-# LANGUAGE OverloadedStrings #-}
+
+-- | Serves EKG metrics for every node of a running cluster, sampled over RPC
+-- whenever the metrics are read.
+module QuorumTools.Mains.LocalMetrics where
+
+import           Control.Concurrent        (threadDelay)
+import           Control.Exception         (try)
+import           Control.Monad             (forever)
+import           Data.Maybe                (fromMaybe)
+import           Data.Optional             (Optional(Specific))
+import qualified Data.Text                 as T
+import           Network.HTTP.Client       (HttpException)
+import           System.Timeout            (timeout)
+import           Turtle                    hiding (view)
+import           Turtle.Options            (HelpMessage(..))
+
+import           QuorumTools.Client        (blockNumber, peerCount,
+                                            pendingTxCount)
+import           QuorumTools.Cluster       (loadLocalCluster, nodeName)
+import           QuorumTools.Metrics       (LocalEkg, localEkg,
+                                            registerGaugeGroup)
+import           QuorumTools.Options       (clusterSizeP)
+import           QuorumTools.Types
+
+data LocalMetricsConfig = LocalMetricsConfig
+  { clusterSize :: Int
+  , metricsPort :: Int
+  }
+
+data NodeSample = NodeSample
+  { sampledBlockNumber :: Either Text Int
+  , sampledPeerCount   :: Either Text Int
+  , sampledPendingTxes :: Either Text Int
+  }
+
+defaultMetricsPort :: Int
+defaultMetricsPort = 8000
+
+-- | How long a node has to answer a sample before we report it as down, so
+-- that one hung node doesn't stall every read of the metrics.
+sampleTimeout :: Int
+sampleTimeout = 1000000 -- 1 second
+
+cliParser :: Parser LocalMetricsConfig
+cliParser = LocalMetricsConfig
+    <$> clusterSizeP
+    <*> (optInt "port" 'p' portMessage <|> pure defaultMetricsPort)
+
+  where
+    portMessage = Specific . HelpMessage $
+      "The port to serve metrics on. Default: "
+        <> T.pack (show defaultMetricsPort)
+
+localMetricsMain :: IO ()
+localMetricsMain = do
+    config <- options "Serves metrics for each node of a local cluster" cliParser
+
+    (_, geths) <- loadLocalCluster PrivacyDisabled (clusterSize config)
+
+    ekg <- localEkg (metricsPort config)
+    mapM_ (registerNodeGauges ekg) geths
+
+    printf ("serving metrics on port "%d%"\n") (metricsPort config)
+
+    -- the EKG server runs in its own thread
+    forever $ threadDelay 1000000
+
+sampleNode :: Geth -> IO NodeSample
+sampleNode geth = fromMaybe timedOut <$> timeout sampleTimeout
+    (NodeSample <$> attempt (blockNumber geth)
+                <*> attempt (peerCount geth)
+                <*> attempt (pendingTxCount geth))
+
+  where
+    timedOut = NodeSample failure failure failure
+    failure = Left "timed out"
+
+    attempt :: IO (Either Text Int) -> IO (Either Text Int)
+    attempt action = either connectionFailure id <$> try action
+
+    connectionFailure :: HttpException -> Either Text Int
+    connectionFailure = Left . T.pack . show
+
+-- | Gauges for monitoring a node, all derived from one sample over RPC:
+-- whether it answers at all, its latest block, its peer count, and its
+-- pending transactions.
+registerNodeGauges :: LocalEkg n -> Geth -> IO ()
+registerNodeGauges ekg geth = registerGaugeGroup ekg (sampleNode geth)
+    [ (gauge "up",           Right . either (const 0) (const 1)
+                               . sampledBlockNumber)
+    , (gauge "block_number", sampledBlockNumber)
+    , (gauge "peer_count",   sampledPeerCount)
+    , (gauge "pending_txes", sampledPendingTxes)
+    ]
+
+  where
+    gauge name = format ("cluster."%s%"."%s) (nodeName (gethId geth)) name
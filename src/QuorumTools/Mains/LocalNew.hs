@@ -5,7 +5,8 @@ module QuorumTools.Mains.LocalNew where
 
 import           Control.Lens              (view, (.~))
 import           Control.Monad.Reader      (runReaderT)
-import           Data.Maybe                (fromMaybe)
+import           Data.Foldable             (for_)
+import           Data.Maybe                (fromMaybe, isJust)
 import           Data.Optional             (Optional(Specific))
 import qualified Data.Set                  as Set
 import qualified Data.Text                 as T
@@ -13,33 +14,67 @@ import           Turtle                    hiding (view)
 import           Turtle.Options            (HelpMessage(..))
 
 import           QuorumTools.Cluster       (generateClusterKeys, mkLocalEnv,
-                                            runNode, wipeAndSetupNodes)
+                                            runNode, wipeAndSetupNodes,
+                                            withCliqueSigners)
 import           QuorumTools.Constellation
 import           QuorumTools.Control       (awaitAll)
-import           QuorumTools.Options       (consensusParser)
+import           QuorumTools.Health        (isHealthy, printNodeHealth,
+                                            verifyCluster)
+import           QuorumTools.Options       (consensusParser,
+                                            defaultClusterSize)
 import           QuorumTools.Types
+import           QuorumTools.Util          (timestampedMessage)
 
 data LocalNewConfig
   = LocalNewConfig { totalPeers   :: Int
                    , initialPeers :: Maybe Int
                    , consensus    :: Consensus
+                   , verifyHealth :: Bool
+                   , numSigners   :: Maybe Int
+                   , timeoutScale :: Int
                    }
 
-defaultClusterSize :: Int
-defaultClusterSize = 3
-
 cliParser :: Parser LocalNewConfig
 cliParser = LocalNewConfig
     <$> (optInt "nodes" 'n' nodesMessage
           <|> pure defaultClusterSize)
     <*> optional (optInt "initial" 'i' initialPeersMessage)
     <*> consensusParser
+    <*> switch "verify" 'v' verifyMessage
+    <*> optional (optInt "signers" 's' signersMessage)
+    <*> (optInt "timeout-scale" 't' timeoutScaleMessage <|> pure 1)
 
   where
     nodesMessage = Specific . HelpMessage $
       "The total number of peers. Default: " <> T.pack (show defaultClusterSize)
     initialPeersMessage =
       "The number of initial peers. Default: the total number of peers."
+    verifyMessage =
+      "Verify the initial peers are connected and reach consensus, exiting if not"
+    signersMessage =
+      "With clique, the number of peers which seal blocks. Default: all of them"
+    timeoutScaleMessage =
+      "Multiply timeouts and the clique block period, for slow machines. Default: 1"
+
+-- | Every problem with the options, so that they can all be fixed at once
+-- before anything is set up.
+configErrors :: LocalNewConfig -> [Text]
+configErrors config = concat
+    [ [ "--nodes must be at least 1" | totalSize < 1 ]
+    , [ "--initial must be between 1 and --nodes (" <> repr totalSize <> ")"
+      | Just initial <- [initialPeers config]
+      , initial < 1 || initial > totalSize ]
+    , [ "--signers must be between 1 and --nodes (" <> repr totalSize <> ")"
+      | Just signers <- [numSigners config]
+      , signers < 1 || signers > totalSize ]
+    , [ "--signers only applies to clique"
+      | isJust (numSigners config)
+      , consensus config /= Clique ]
+    , [ "--timeout-scale must be at least 1" | timeoutScale config < 1 ]
+    ]
+
+  where
+    totalSize = totalPeers config
 
 localNewMain :: IO ()
 localNewMain = do
@@ -49,14 +84,19 @@ localNewMain = do
         initialSize = fromMaybe totalSize (initialPeers config)
         gids        = clusterGids totalSize
 
-    when (totalSize < initialSize) $
-      error "initial peers can not be greater than total peers"
+    case configErrors config of
+      [] -> pure ()
+      errs -> do
+        for_ errs $ printf ("error: "%s%"\n")
+        exit $ ExitFailure 1
 
     keys <- generateClusterKeys gids password
     let cEnv = mkLocalEnv keys (consensus config)
              & clusterPrivacySupport .~ PrivacyEnabled
              & clusterInitialMembers .~ Set.fromList (take initialSize gids)
              & clusterPassword       .~ password
+             & clusterTimeoutScale   .~ timeoutScale config
+             & maybe id (withCliqueSigners . flip take gids) (numSigners config)
 
     sh $ flip runReaderT cEnv $ do
       geths <- wipeAndSetupNodes Nothing "gdata" gids
@@ -66,8 +106,20 @@ localNewMain = do
 
       instruments <- traverse (runNode totalSize) geths
 
+      when (verifyHealth config) $ do
+        let initialGeths = take initialSize geths
+        timestampedMessage "verifying cluster health"
+        healths <- verifyCluster (verificationAttempts * timeoutScale config)
+                                 initialGeths
+        if all isHealthy healths
+        then timestampedMessage "cluster verified"
+        else do
+          mapM_ printNodeHealth healths
+          exit $ ExitFailure 1
+
       awaitAll $ nodeTerminated <$> instruments
 
   where
-    password    = CleartextPassword "abcd"
-    parseConfig = options "Creates a new local cluster" cliParser
+    password             = CleartextPassword "abcd"
+    parseConfig          = options "Creates a new local cluster" cliParser
+    verificationAttempts = 30
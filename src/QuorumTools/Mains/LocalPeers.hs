@@ -0,0 +1,34 @@
+{-# LANGUAGE OverloadedStrings #-}
+
+-- | Prints which nodes of a running cluster report which others as peers.
+module QuorumTools.Mains.LocalPeers where
+
+import           Control.Monad.Reader      (runReaderT)
+import qualified Data.Text.IO              as T
+import           Turtle                    hiding (view)
+
+import           QuorumTools.Cluster       (loadLocalCluster)
+import           QuorumTools.Options       (clusterSizeP)
+import           QuorumTools.PeerMatrix
+import           QuorumTools.Types
+
+data LocalPeersConfig = LocalPeersConfig
+  { clusterSize :: Int
+  , asDot       :: Bool
+  }
+
+cliParser :: Parser LocalPeersConfig
+cliParser = LocalPeersConfig
+    <$> clusterSizeP
+    <*> switch "dot" 'd' "Print a Graphviz digraph instead of a matrix"
+
+localPeersMain :: IO ()
+localPeersMain = do
+    config <- options "Shows the peers of each node of a local cluster" cliParser
+
+    let render = if asDot config then renderDot else renderMatrix
+
+    (cEnv, geths) <- loadLocalCluster PrivacyDisabled (clusterSize config)
+    matrix <- runReaderT (peerMatrix geths) cEnv
+
+    T.putStr $ render matrix
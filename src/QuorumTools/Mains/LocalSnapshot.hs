@@ -0,0 +1,55 @@
+{-# LANGUAGE OverloadedStrings #-}
+
+-- | Snapshots the datadir of a stopped node to a tarball, or restores one, e.g.
+-- to test recovering from corrupted state.
+module QuorumTools.Mains.LocalSnapshot where
+
+import           Data.Optional             (Optional(Specific))
+import           Turtle
+import           Turtle.Options            (HelpMessage(..))
+
+import           QuorumTools.Cluster       (archiveDataDir, nodeName,
+                                            restoreDataDir)
+import           QuorumTools.Types
+
+data LocalSnapshotConfig = LocalSnapshotConfig
+  { snapshotGethId :: GethId
+  , snapshotDir    :: FilePath
+  , restore        :: Bool
+  }
+
+defaultSnapshotDir :: FilePath
+defaultSnapshotDir = "snapshots"
+
+cliParser :: Parser LocalSnapshotConfig
+cliParser = LocalSnapshotConfig
+    <$> (GethId <$> optInt "geth" 'g' "The Geth ID of the (stopped) local node")
+    <*> (optPath "dir" 'd' dirMessage <|> pure defaultSnapshotDir)
+    <*> switch "restore" 'r' "Restore the node's snapshot instead of taking one"
+
+  where
+    dirMessage = Specific . HelpMessage $
+      "The directory holding snapshots. Default: "
+        <> format fp defaultSnapshotDir
+
+localSnapshotMain :: IO ()
+localSnapshotMain = do
+    config <- options "Snapshots or restores a stopped local node" cliParser
+
+    let gid     = snapshotGethId config
+        name    = fromText (nodeName gid)
+        dataDir = DataDir $ "gdata" </> name
+        tarball = snapshotDir config </> name <.> "tar.gz"
+
+    if restore config
+    then do
+      result <- restoreDataDir tarball dataDir
+      case result of
+        Left err -> do
+          printf ("failed to restore "%s%": "%s%"\n") (nodeName gid) err
+          exit (ExitFailure 1)
+        Right () ->
+          printf ("restored "%s%" from "%fp%"\n") (nodeName gid) tarball
+    else do
+      path <- archiveDataDir [] dataDir (snapshotDir config)
+      printf ("wrote "%fp%"\n") path
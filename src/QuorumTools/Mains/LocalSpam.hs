@@ -20,6 +20,8 @@ data LocalSpamConfig = LocalSpamConfig
   , rateLimit    :: RateLimit Microsecond
   , contractAddr :: Maybe Text
   , privateFor   :: Maybe Text
+  , payloadSize  :: Maybe Int
+  , metricsPort  :: Maybe Int
   }
 
 cliParser :: Parser LocalSpamConfig
@@ -28,6 +30,8 @@ cliParser = LocalSpamConfig
     <*> rateLimitP
     <*> optional contractP
     <*> optional privateForP
+    <*> optional payloadP
+    <*> optional metricsPortP
   where
     gethIdP = GethId <$>
       optInt     "geth" 'g' "The Geth ID of the local node to spam"
@@ -35,16 +39,22 @@ cliParser = LocalSpamConfig
       optInteger "rps"  'r' "The number of requests per second"
 
 localSpam :: LocalSpamConfig -> IO ()
-localSpam (LocalSpamConfig gid rateLimit' contractM privateForM) = do
+localSpam (LocalSpamConfig gid rateLimit' contractM privateForM payloadM portM) = do
+    benchTx <- either die pure $ case payloadM of
+      Nothing   -> Right $ processContractArgs contractM privateForM
+      Just size -> processPayloadArgs size privateForM
+
     keys <- Map.singleton gid <$> readAccountKey dataDir gid
     geth <- runReaderT (loadNode gid) (mkLocalEnv keys Raft)
-    let store = Metrics.blackhole
 
-    spamGeth store benchTx rateLimit' geth
+    case portM of
+      Nothing   -> spamGeth Metrics.blackhole benchTx rateLimit' geth
+      Just port -> do
+        store <- Metrics.localEkg port
+        spamGeth store benchTx rateLimit' geth
 
   where
     dataDir = DataDir $ "gdata" </> fromText (nodeName gid)
-    benchTx = processContractArgs contractM privateForM
 
 localSpamMain :: IO ()
 localSpamMain = localSpam =<< options "Local geth spammer" cliParser
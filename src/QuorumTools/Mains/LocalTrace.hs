@@ -0,0 +1,71 @@
+{-# LANGUAGE OverloadedStrings #-}
+
+-- | Traces a transaction on every node of a running cluster and reports where
+-- the traces differ, e.g. to track down diverging private state.
+module QuorumTools.Mains.LocalTrace where
+
+import           Control.Monad.Reader      (runReaderT)
+import           Data.Aeson                (Value)
+import qualified Data.Text                 as T
+import           Turtle                    hiding (view)
+
+import           QuorumTools.Client        (traceTransaction)
+import           QuorumTools.Cluster       (loadLocalCluster, nodeName)
+import           QuorumTools.Options       (clusterSizeP)
+import           QuorumTools.Types
+import           QuorumTools.Util          (textEncode, textToBytes32)
+
+data LocalTraceConfig = LocalTraceConfig
+  { clusterSize :: Int
+  , txHash      :: Text
+  , tracer      :: Maybe Text
+  }
+
+cliParser :: Parser LocalTraceConfig
+cliParser = LocalTraceConfig
+    <$> clusterSizeP
+    <*> optText "tx" 't' "The hash of the transaction to trace"
+    <*> optional (optText "tracer" 'r' tracerMessage)
+
+  where
+    tracerMessage =
+      "The tracer to use, e.g. callTracer or prestateTracer. Default: struct logs"
+
+-- | Groups nodes by the result they returned, in order of first appearance.
+groupResults :: [(GethId, Either Text Value)]
+             -> [(Either Text Value, [GethId])]
+groupResults = foldl insert []
+  where
+    insert groups (gid, result) = case break ((== result) . fst) groups of
+      (before, (_, gids) : after) -> before <> [(result, gids <> [gid])] <> after
+      (_, [])                     -> groups <> [(result, [gid])]
+
+localTraceMain :: IO ()
+localTraceMain = do
+    config <- options "Traces a transaction on every node of a local cluster"
+                      cliParser
+
+    tid <- case textToBytes32 (txHash config) of
+      Just bytes -> pure $ TxId bytes
+      Nothing    -> die $ "invalid transaction hash: " <> txHash config
+
+    (cEnv, geths) <- loadLocalCluster PrivacyDisabled (clusterSize config)
+    results <- flip runReaderT cEnv $
+      traverse (\geth -> traceTransaction geth (tracer config) tid) geths
+
+    let gids = gethId <$> geths
+
+    case groupResults (zip gids results) of
+      [(result, _)] -> do
+        printf ("all "%d%" nodes agree\n") (length gids)
+        printResult result
+      groups -> do
+        printf ("nodes disagree ("%d%" distinct results)\n") (length groups)
+        forM_ groups $ \(result, groupGids) -> do
+          printf (s%":\n") (T.intercalate ", " $ nodeName <$> groupGids)
+          printResult result
+        exit $ ExitFailure 1
+
+  where
+    printResult (Left err)    = printf ("  error: "%s%"\n") err
+    printResult (Right trace) = printf ("  "%s%"\n") (textEncode trace)
@@ -0,0 +1,43 @@
+{-# LANGUAGE OverloadedStrings #-}
+
+-- | Changes the log verbosity of every geth node in a running cluster at once,
+-- e.g. to turn on verbose logs only while reproducing a bug.
+module QuorumTools.Mains.LocalVerbosity where
+
+import           Control.Monad.Reader      (runReaderT)
+import           Data.Either               (isRight)
+import           Turtle                    hiding (view)
+
+import           QuorumTools.Client        (setClusterVerbosity)
+import           QuorumTools.Cluster       (loadLocalCluster, nodeName)
+import           QuorumTools.Options       (clusterSizeP)
+import           QuorumTools.Types
+
+data LocalVerbosityConfig = LocalVerbosityConfig
+  { clusterSize :: Int
+  , verbosity   :: Verbosity
+  }
+
+cliParser :: Parser LocalVerbosityConfig
+cliParser = LocalVerbosityConfig
+    <$> clusterSizeP
+    <*> (Verbosity <$> optInt "verbosity" 'v' verbosityMessage)
+
+  where
+    verbosityMessage =
+      "The new log level: 0=silent, 1=error, 2=warn, 3=info, 4=debug, 5=detail"
+
+localVerbosityMain :: IO ()
+localVerbosityMain = do
+    config <- options "Changes the log level of a local cluster" cliParser
+
+    (cEnv, geths) <- loadLocalCluster PrivacyDisabled (clusterSize config)
+    results <- runReaderT (setClusterVerbosity (verbosity config) geths) cEnv
+
+    forM_ (zip geths results) $ \(geth, result) -> case result of
+      Left err -> printf ("failed to set verbosity for "%s%": "%s%"\n")
+                         (nodeName $ gethId geth)
+                         err
+      Right () -> pure ()
+
+    unless (all isRight results) $ exit (ExitFailure 1)
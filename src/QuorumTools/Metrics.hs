@@ -12,13 +12,16 @@ module QuorumTools.Metrics
   , Metric (..)
   , mkSendTxState
   , blackhole
+  , LocalEkg
   , localEkg
+  , registerGaugeGroup
   ) where
 
 import           Control.Concurrent          (MVar, modifyMVar, newMVar)
 import           Control.Lens                ((^.), (<&>), makeLenses)
 import           Control.Monad.IO.Class      (MonadIO, liftIO)
 import           Data.AffineSpace            ((.-.))
+import qualified Data.HashMap.Strict         as HashMap
 import           Data.Text                   (Text)
 import           Data.Thyme.Clock            (UTCTime, getCurrentTime,
                                               microseconds)
@@ -134,5 +137,21 @@ localEkg port = do
 
   return $ LocalEkg server logger
 
+-- | Registers a group of gauges which are all derived from one sample, taken
+-- each time the metrics are read rather than updated as we go. Failed samples
+-- are reported as -1.
+registerGaugeGroup :: MonadIO m
+                   => LocalEkg n
+                   -> IO a
+                   -> [(Text, a -> Either Text Int)]
+                   -> m ()
+registerGaugeGroup (LocalEkg server _) sample gauges = liftIO $
+    EKG.registerGroup (HashMap.fromList $ fmap gauge <$> gauges)
+                      sample
+                      (EKG.serverMetricStore server)
+
+  where
+    gauge f = EKG.Gauge . either (const (-1)) fromIntegral . f
+
 instance MonadIO m => Store m (LocalEkg m) where
   log (LocalEkg _ (MetricLogger logMetric)) = logMetric
@@ -2,7 +2,10 @@
 
 module QuorumTools.Options where
 
+import           Data.Optional             (Optional(Specific))
+import qualified Data.Text                 as T
 import           Turtle                    hiding (view)
+import           Turtle.Options            (HelpMessage(..))
 
 import           QuorumTools.Types
 
@@ -16,3 +19,14 @@ consensusParser = opt parse "consensus" 'c' msg <|> pure Raft
     parse "clique" = Just Clique
     parse "pow"    = Just ProofOfWork
     parse _        = Nothing
+
+defaultClusterSize :: Int
+defaultClusterSize = 3
+
+-- | The number of nodes in an existing local cluster.
+clusterSizeP :: Parser Int
+clusterSizeP = optInt "nodes" 'n' msg <|> pure defaultClusterSize
+  where
+    msg = Specific . HelpMessage $
+      "The number of nodes in the cluster. Default: "
+        <> T.pack (show defaultClusterSize)
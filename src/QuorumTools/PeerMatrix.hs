@@ -0,0 +1,84 @@
+{-# LANGUAGE OverloadedStrings #-}
+
+-- | Which nodes of a cluster report which others as peers, so that breakage
+-- in the mesh is visible at a glance.
+module QuorumTools.PeerMatrix
+  ( PeerMatrix (..)
+  , peerMatrix
+  , renderMatrix
+  , renderDot
+  ) where
+
+import           Data.Map.Strict     (Map)
+import qualified Data.Map.Strict     as Map
+import           Data.Maybe          (mapMaybe)
+import           Data.Set            (Set)
+import qualified Data.Set            as Set
+import qualified Data.Text           as T
+import           Prelude             hiding (FilePath)
+import           Turtle
+
+import           QuorumTools.Client  (peerNodeIds)
+import           QuorumTools.Cluster (nodeName)
+import           QuorumTools.Types
+
+-- | For each node, either the nodes it reports as peers, or the error we got
+-- asking it.
+newtype PeerMatrix = PeerMatrix (Map GethId (Either Text (Set GethId)))
+  deriving (Eq, Show)
+
+-- | The hex node ID of an enode URL, e.g. @enode://<node ID>\@127.0.0.1:30401@
+enodeNodeId :: EnodeId -> Text
+enodeNodeId (EnodeId eid) =
+  T.takeWhile (/= '@') $ T.drop (T.length "enode://") eid
+
+peerMatrix :: MonadIO m => [Geth] -> m PeerMatrix
+peerMatrix geths = PeerMatrix . Map.fromList <$> traverse row geths
+  where
+    byNodeId :: Map Text GethId
+    byNodeId = Map.fromList
+      [(enodeNodeId (gethEnodeId geth), gethId geth) | geth <- geths]
+
+    -- peers outside of this cluster (e.g. the bootnode) are left out
+    row geth = (,) (gethId geth) . fmap toGids <$> peerNodeIds geth
+    toGids = Set.fromList . mapMaybe (`Map.lookup` byNodeId)
+
+-- | An NxN grid, with an @x@ wherever the node of the row reports the node of
+-- the column as a peer.
+renderMatrix :: PeerMatrix -> Text
+renderMatrix (PeerMatrix rows) = T.unlines $ header : fmap renderRow entries
+  where
+    entries = Map.toList rows
+    gids = fst <$> entries
+    width = maximum $ 0 : fmap (T.length . nodeName) gids
+
+    pad = T.justifyLeft width ' '
+    header = T.unwords $ pad "" : fmap nodeName gids
+
+    renderRow (gid, Left msg) = T.unwords [pad (nodeName gid), "error:", msg]
+    renderRow (gid, Right peers) = T.unwords $
+      pad (nodeName gid) : fmap (renderCell gid peers) gids
+
+    -- each cell is as wide as its column's header
+    renderCell gid peers other =
+      T.justifyLeft (T.length (nodeName other)) ' ' $ cell gid peers other
+
+    cell gid peers other
+      | gid == other             = "-"
+      | other `Set.member` peers = "x"
+      | otherwise                = "."
+
+-- | A Graphviz digraph with an edge from each node to each of its peers. Nodes
+-- that failed to respond are drawn in red.
+renderDot :: PeerMatrix -> Text
+renderDot (PeerMatrix rows) = T.unlines $
+    ["digraph peers {"] <> concatMap renderNode (Map.toList rows) <> ["}"]
+
+  where
+    quoted gid = "\"" <> nodeName gid <> "\""
+
+    renderNode (gid, Left _msg) = ["  " <> quoted gid <> " [color=red];"]
+    renderNode (gid, Right peers) =
+      ("  " <> quoted gid <> ";") :
+        [ "  " <> quoted gid <> " -> " <> quoted peer <> ";"
+        | peer <- Set.toList peers ]
@@ -3,8 +3,10 @@
 module QuorumTools.Spam where
 
 import           Data.Char            (isHexDigit)
+import           Data.Optional        (Optional(Specific))
 import qualified Data.Text            as T
 import           Turtle               hiding (char)
+import           Turtle.Options       (HelpMessage(..))
 
 import           QuorumTools.Types
 import           QuorumTools.Util     (Bytes20, bytes20P, HexPrefix(..),
@@ -29,22 +31,49 @@ pubKeyP = Secp256k1 . T.pack <$> count 44 b64Digit
 privateForPattern :: Pattern [PublicKey]
 privateForPattern = pubKeyP `sepBy` ","
 
+processPrivacy :: Text -> Privacy
+processPrivacy rawPrivateFor = case matchOnce privateForPattern rawPrivateFor of
+  Nothing -> Public
+  Just addrs -> PrivateFor addrs
+
 processContractArgs :: Maybe Text -> Maybe Text -> SpamMode
 processContractArgs contractT privateForT = maybe SpamEmptyTx SpamTx $ do
   rawContract <- contractT
-  rawPrivateFor <- privateForT
-
-  let privacy = case matchOnce privateForPattern rawPrivateFor of
-        Nothing -> Public
-        Just addrs -> PrivateFor addrs
+  privacy <- processPrivacy <$> privateForT
 
   (addr, method) <- matchOnce contractPattern rawContract
   pure $ Tx (Just addr) method privacy Async
 
+-- | Payloads are sent hex-encoded in a single JSON-RPC request, and geth
+-- refuses HTTP request bodies over 128 KB. This leaves room for the rest of
+-- the request, including a long --privatefor list.
+maxPayloadSize :: Int
+maxPayloadSize = 60000
+
+-- | Payload transactions must be private: as public transactions, the payload
+-- would be calldata, which would quickly exceed the gas we send them with.
+processPayloadArgs :: Int -> Maybe Text -> Either Text SpamMode
+processPayloadArgs size privateForT
+  | size > maxPayloadSize = Left $
+    format ("--payload can be at most "%d%" bytes") maxPayloadSize
+  | otherwise = case privateForT >>= matchOnce privateForPattern of
+    Just addrs -> Right $ SpamPayload size (PrivateFor addrs)
+    Nothing    -> Left "--payload requires a valid --privatefor"
+
 contractP :: Parser Text
 contractP = optText "contract" 'c'
   "Contract address and method <addr>:increment()"
 
+payloadP :: Parser Int
+payloadP = optInt "payload" 's' $ Specific . HelpMessage $ format
+  ("Send private transactions carrying this many bytes of data, at most "%d%
+   " (requires --privatefor)")
+  maxPayloadSize
+
+metricsPortP :: Parser Int
+metricsPortP = optInt "metrics-port" 'm'
+  "Serve EKG metrics (e.g. send latency and rejections) on this port"
+
 privateForP :: Parser Text
 privateForP = optText "privatefor" 'p'
   "Comma-separated addresses with access to this transaction"
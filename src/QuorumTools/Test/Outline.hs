@@ -2,18 +2,21 @@
 {-# LANGUAGE LambdaCase                 #-}
 {-# LANGUAGE OverloadedStrings          #-}
 {-# LANGUAGE GeneralizedNewtypeDeriving #-}
+{-# LANGUAGE ScopedTypeVariables        #-}
 
 module QuorumTools.Test.Outline where
 
 import           Control.Concurrent        (threadDelay)
 import           Control.Concurrent.Async  (Async, async, cancel, poll)
 import           Control.Concurrent.MVar   (readMVar, newEmptyMVar, putMVar)
+import           Control.Exception         (SomeException, try)
 import           Control.Lens
 import           Control.Monad             (forM_)
 import           Control.Monad.Except
 import           Control.Monad.Managed     (MonadManaged)
 import           Control.Monad.Reader      (ReaderT (runReaderT), ask)
 import           Data.Foldable             (for_, toList)
+import           Data.Maybe                (isNothing)
 import           Data.Monoid               (Last (Last))
 import           Data.Monoid.Same          (Same (NotSame, Same), allSame)
 import           Data.Set                  (Set)
@@ -27,7 +30,8 @@ import qualified QuorumTools.PacketFilter  as PF
 import           Prelude                   hiding (FilePath)
 import           System.Console.ANSI
 import           System.Info
-import           Turtle
+import           Text.Read                 (readMaybe)
+import           Turtle                    hiding (view)
 
 import           QuorumTools.Client
 import           QuorumTools.Cluster
@@ -53,7 +57,11 @@ data FailureReason
   | WrongValue [(GethId, Int, Either Text Int)]
   | BlockDivergence (Vector (Last Block))
   | BlockConvergenceTimeout
+  | ElectionTimeout
   | RpcFailure Text
+  -- Each transaction whose receipts differ, or which some node can't return a
+  -- receipt for, with every node's receipt
+  | ReceiptDivergence [(TxId, [(GethId, Either Text (Maybe Receipt))])]
   deriving Show
 
 data Validity
@@ -86,7 +94,14 @@ printFailureReason reason = withColor Red $ case reason of
   RemoveNodeFailure -> putStrLn "Failed to remove a node"
   BlockDivergence blocks -> putStrLn $ "different last blocks on each node: " ++ show (toList blocks)
   BlockConvergenceTimeout -> putStrLn "blocks failed to converge before timeout"
+  ElectionTimeout -> putStrLn "no raft election succeeded before timeout"
   RpcFailure msg -> putStrLn $ "rpc failure: " <> T.unpack msg
+  ReceiptDivergence mismatches -> do
+    putStrLn "Nodes lack or disagree on transaction receipts:"
+    forM_ mismatches $ \(tid, receipts) -> do
+      putStrLn $ "  " ++ show tid
+      forM_ receipts $ \(GethId n, receipt) ->
+        putStrLn $ "    geth " ++ show n ++ ": " ++ show receipt
 
 instance Monoid Validity where
   mempty = Verified
@@ -116,6 +131,16 @@ type TestPredicate = TestNum -> ShouldTerminate
 
 type TestM = ExceptT FailureReason (ReaderT ClusterEnv Shell)
 
+-- | How much to stretch the test suite's timeouts and waits by, for machines
+-- too slow to keep up with the defaults. Set with the @TIMEOUT_SCALE@
+-- environment variable; defaults to 1.
+timeoutScaleFromEnv :: IO Int
+timeoutScaleFromEnv = do
+  mScale <- need "TIMEOUT_SCALE"
+  pure $ case readMaybe . T.unpack =<< mScale of
+    Just scale | scale >= 1 -> scale
+    _                       -> 1
+
 -- | Run this test up to @TestNum@ times or until it fails
 tester
   :: TestPredicate
@@ -137,11 +162,14 @@ tester p privacySupport consensus numNodes cb = foldr go mempty [0..] >>= \case
           gids = [1..GethId numNodes']
 
       keys <- generateClusterKeys gids password
+      scale <- timeoutScaleFromEnv
+      started <- date
 
       let -- blockMaker:voters = gids
           cEnv = mkLocalEnv keys consensus
                & clusterPrivacySupport .~ privacySupport
                & clusterPassword       .~ password
+               & clusterTimeoutScale   .~ scale
 
       putStrLn $ "test #" ++ show (unTestNum testNum)
 
@@ -154,14 +182,16 @@ tester p privacySupport consensus numNodes cb = foldr go mempty [0..] >>= \case
         instruments <- traverse (runNode numNodes') geths
 
         timestampedMessage "awaiting a successful raft election"
-        awaitAll (assumedRole <$> instruments)
+        elected <- wait =<< timeLimit (30 * fromIntegral scale :: Second)
+                        =<< fork (awaitAll (assumedRole <$> instruments))
+        when (isNothing elected) $ throwError ElectionTimeout
         timestampedMessage "initial election succeeded"
 
         -- perform the actual test
         cb (zip geths instruments)
 
         -- pause a second before checking last block
-        td 1
+        td scale
 
         let verifier = verify (lastBlock <$> instruments)
                               (outstandingTxes <$> instruments)
@@ -170,14 +200,24 @@ tester p privacySupport consensus numNodes cb = foldr go mempty [0..] >>= \case
         -- wait an extra five seconds to guarantee raft has a chance to
         -- converge
         liftIO $ runTestM cEnv verifier >>= \case
-          Left (WrongOrder _ _) -> td 5
-          Left NoBlockFound     -> td 5
+          Left (WrongOrder _ _) -> td $ 5 * scale
+          Left NoBlockFound     -> td $ 5 * scale
           _                     -> pure ()
 
         verifier
 
       case result of
-        Left reason -> printFailureReason reason >> pure DoTerminateFailure
+        Left reason -> do
+          printFailureReason reason
+          -- archiving is best-effort: nothing may mask the test's failure
+          archived <- try $ archiveLogs started $ "logs" </> fromText
+            (format ("test-"%d%".tar.gz") (unTestNum testNum))
+          case archived of
+            Left (err :: SomeException) ->
+              printf ("failed to archive node logs: "%w%"\n") err
+            Right Nothing -> pure ()
+            Right (Just logs) -> printf ("node logs archived to "%fp%"\n") logs
+          pure DoTerminateFailure
         Right ()    -> case p testNum of
           DontTerminate -> runMoreTests
           term          -> pure term
@@ -279,15 +319,23 @@ td :: MonadIO m => Int -> m ()
 td = liftIO . threadDelay . (* second)
 
 addsNode :: Geth -> Geth -> TestM ()
-existingMember `addsNode` newcomer = do
-  let message = "adding node " <> T.pack (show (gId (gethId newcomer)))
-  timestampedMessage $ "waiting before " <> message
+existingMember `addsNode` newcomer = void $ existingMember `admits` newcomer
+
+-- | Like 'addsNode', but returns the newcomer set up to join with the raft ID
+-- it was assigned.
+admits :: Geth -> Geth -> TestM Geth
+existingMember `admits` newcomer = do
+  -- the newcomer's raft ID is only known once the cluster assigns it
+  timestampedMessage "waiting before adding a node"
   td 2
-  timestampedMessage message
-  result <- addNode existingMember (gethEnodeId newcomer)
+  timestampedMessage "adding a node"
+  result <- joinRaftCluster existingMember newcomer
   case result of
     Left _err -> throwError AddNodeFailure
-    Right _raftId -> return ()
+    Right joiner -> do
+      timestampedMessage $
+        "added node " <> T.pack (show (gId (gethId joiner)))
+      return joiner
 
 removesNode :: Geth -> Geth -> TestM ()
 existingMember `removesNode` target = do
@@ -303,14 +351,38 @@ existingMember `removesNode` target = do
 -- NOTE: This currently assumes raft-based consensus, due to the short duration.
 -- Once we have first-class support for multiple types of consensus, this should
 -- be aware of the expected latency across consensus mechanisms.
-blockConvergence :: (MonadManaged m, Traversable t)
+blockConvergence :: (MonadManaged m, HasEnv m, Traversable t)
                  => t NodeInstrumentation
                  -> m (Async (Maybe (Either (Vector (Last Block)) Block)))
-blockConvergence = timeLimit (10 :: Second)
-               <=< convergence (1 :: Second) . fmap lastBlock
+blockConvergence instruments = do
+  scale <- view clusterTimeoutScale
+  timeLimit (10 * fromIntegral scale :: Second)
+    =<< convergence (1 :: Second) (lastBlock <$> instruments)
+
+-- | Compares the receipts of up to the given number of recent transactions
+-- across all nodes, failing on any difference in status, gas used or logs
+-- bloom. Transactions are sampled from the first node's blocks, so every node
+-- must also return a well-formed receipt for each of them.
+verifyReceipts :: Int -> [Geth] -> TestM ()
+verifyReceipts _ [] = pure ()
+verifyReceipts n geths@(sampler:_) = do
+    tids <- either (throwError . RpcFailure) pure =<< recentTxIds sampler n
+    mismatches <- fmap concat $ forM tids $ \tid -> do
+      receipts <- forM geths $ \geth ->
+        (,) (gethId geth) <$> transactionReceipt geth tid
+      let results = snd <$> receipts
+      pure [ (tid, receipts) | any unusable results || disagree results ]
+    unless (null mismatches) $ throwError $ ReceiptDivergence mismatches
+
+  where
+    unusable (Right (Just _)) = False
+    unusable _                = True
+
+    disagree []     = False
+    disagree (r:rs) = any (/= r) rs
 
 awaitBlockConvergence
-  :: (MonadManaged m, MonadError FailureReason m, Traversable t)
+  :: (MonadManaged m, MonadError FailureReason m, HasEnv m, Traversable t)
   => t NodeInstrumentation
   -> m ()
 awaitBlockConvergence instruments = do
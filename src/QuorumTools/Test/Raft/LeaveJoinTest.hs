@@ -45,11 +45,7 @@ leaveJoinTestMain = do
 
     _ <- liftIO $ killNode (head instruments)
 
-    let g4 = g1 { gethId = 4
-                , gethJoinMode = JoinExisting
-                }
-
-    g3 `addsNode` g4
+    g4 <- g3 `admits` g1
 
     g4i <- runNode clusterSize g4
 
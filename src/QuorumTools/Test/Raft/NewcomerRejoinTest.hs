@@ -55,11 +55,7 @@ newcomerRejoinTestMain = do
 
     td 1
 
-    let g4 = g3 { gethId = 4
-                , gethJoinMode = JoinExisting
-                }
-
-    g2 `addsNode` g4
+    g4 <- g2 `admits` g3
 
     g4i <- runNode clusterSize g4
 
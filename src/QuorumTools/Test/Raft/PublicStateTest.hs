@@ -28,6 +28,7 @@ publicStateTestMain = testNTimes 1 PrivacyDisabled Raft (NumNodes 3) $ \iNodes -
     incrementStorage geth Sync contract storageAddr
 
   awaitBlockConvergence instruments
+  verifyReceipts increments geths
 
   [i1, i2, i3] <- traverse (getStorage contract storageAddr) geths
 
@@ -29,6 +29,32 @@ data ConstellationConfig = ConstellationConfig
   , ccDataDir    :: DataDir -- TODO: probably pull this out
   , ccPort       :: Port
   , ccOtherNodes :: [Text]
+  , ccTls        :: Maybe ConstellationTls
+  } deriving (Eq, Show)
+
+-- | How a constellation node verifies its peers' certificates. See
+-- constellation's sample.conf for the semantics of each mode. Only the modes
+-- that work with generated, self-signed certificates are supported: we have no
+-- way to supply whitelists (known hosts) or certificate chains.
+data TlsTrust
+  = TrustTofu
+  | TrustCaOrTofu
+  | TrustNoValidation
+  deriving (Eq, Show)
+
+-- | TLS between constellation nodes. Any certificates missing from a node's
+-- datadir are generated, self-signed, by constellation when it starts. Health
+-- checks against these nodes call upcheck through @curl@. None of the
+-- executables set this up yet.
+data ConstellationTls = ConstellationTls
+  { tlsServerTrust :: TlsTrust -- mutual TLS unless 'TrustNoValidation'
+  , tlsClientTrust :: TlsTrust
+  } deriving (Eq, Show)
+
+-- | Paths to an existing key pair, used instead of generating a fresh one
+data ConstellationKeyPair = ConstellationKeyPair
+  { ckpPublicKey  :: FilePath
+  , ckpPrivateKey :: FilePath
   } deriving (Eq, Show)
 
 -- Geth / Cluster
@@ -79,10 +105,16 @@ data ConsensusConfig
 
 data ConsensusPeer
   = RaftPeer Port
-  | CliquePeer
+  | CliquePeer CliqueRole
   | PowPeer
   deriving (Eq, Show)
 
+-- | Whether a clique node seals blocks, or only follows the chain
+data CliqueRole
+  = CliqueSigner
+  | CliqueFollower
+  deriving (Eq, Show)
+
 data PrivacySupport
   = PrivacyEnabled
   | PrivacyDisabled
@@ -135,6 +167,8 @@ data Geth =
        , gethIp                  :: Ip
        , gethUrl                 :: Text
        , gethConstellationConfig :: Maybe FilePath
+       , gethExtraArgs           :: [Text]
+       , gethEnvironment         :: [(Text, Text)]
        }
   deriving (Show, Eq)
 
@@ -181,12 +215,20 @@ data CreateArgs = CreateArgs Contract Bytes32 TxSync
 data SpamMode
   = SpamEmptyTx
   | SpamTx Tx
+  | SpamPayload Int Privacy -- a synchronous tx carrying this many bytes of data
 
 newtype UnencodedMethod = UnencodedMethod Text deriving IsString
 
 newtype TxId = TxId { txId :: Bytes32 }
   deriving (Show, Eq, Ord)
 
+-- | The parts of a transaction receipt every node should agree on
+data Receipt = Receipt
+  { receiptStatus    :: Text
+  , receiptGasUsed   :: Int
+  , receiptLogsBloom :: Text
+  } deriving (Eq, Show)
+
 newtype Block = Block Bytes32
   deriving (Eq, Show)
 
@@ -289,11 +331,25 @@ data ClusterEnv
                --
                , _clusterConstellationConfs    :: Map GethId FilePath
                , _clusterAccountKeys           :: Map GethId AccountKey
+               -- Existing nodekey files, for nodes with fixed enode IDs
+               , _clusterNodeKeys              :: Map GethId FilePath
+               , _clusterConstellationKeys     :: Map GethId ConstellationKeyPair
+               , _clusterConstellationTls      :: Maybe ConstellationTls
+               -- Directories of existing certificates, named as in
+               -- 'QuorumTools.Constellation.tlsFiles'
+               , _clusterConstellationCerts    :: Map GethId FilePath
+               -- Per-node geth flags and environment variables, e.g. to pass
+               -- feature flags to specific nodes
+               , _clusterExtraGethArgs         :: Map GethId [Text]
+               , _clusterGethEnvironment       :: Map GethId [(Text, Text)]
                , _clusterInitialMembers        :: Set GethId
                , _clusterInitialBalances       :: Map AccountId Integer
                , _clusterConsensusConfig       :: ConsensusConfig
                , _clusterMode                  :: ClusterMode
                , _clusterPrivacySupport        :: PrivacySupport
+               -- Multiplies timeouts and the clique block period, for machines
+               -- too slow to keep up with the defaults
+               , _clusterTimeoutScale          :: Int
                }
   deriving (Eq, Show)
 